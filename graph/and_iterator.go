@@ -0,0 +1,327 @@
+// Copyright 2014 The Cayley Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+// The And iterator is the standard intersection iterator. Given a set of
+// subiterators, it picks one ("primary") to walk with Next() and checks every
+// value it produces against the rest of the subiterators via Check(). This is
+// the classic "leapfrog" strategy -- the primary drives iteration and the
+// others merely confirm membership, which is normally much cheaper than
+// nexting every branch in lockstep.
+//
+// OptionalIterator branches cannot usefully be nexted (their NextCost is
+// 1<<62) so they can be folded in separately, via AddOptionalIterator, as
+// "opt" subiterators -- they never
+// drive iteration or gate Check(), but they still need a chance to set their
+// tags, so TagResults fans out to them as well.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AndIterator is the intersection of two or more iterators.
+type AndIterator struct {
+	BaseIterator
+	primaryIt Iterator
+	subIts    []Iterator
+	checkList []Iterator
+	opt       []Iterator
+}
+
+// NewAndIterator creates a new And iterator over the given subiterators. The
+// first subiterator is used as the primary until Optimize() has a chance to
+// pick a cheaper one.
+func NewAndIterator(subs ...Iterator) *AndIterator {
+	var it AndIterator
+	BaseIteratorInit(&it.BaseIterator)
+	it.subIts = make([]Iterator, 0, len(subs))
+	if len(subs) > 0 {
+		it.primaryIt = subs[0]
+		it.subIts = append(it.subIts, subs[1:]...)
+	}
+	it.checkList = nil
+	return &it
+}
+
+// AddSubIterator adds another subconstraint to the And.
+func (it *AndIterator) AddSubIterator(sub Iterator) {
+	if it.primaryIt == nil {
+		it.primaryIt = sub
+		return
+	}
+	it.subIts = append(it.subIts, sub)
+}
+
+// AddOptionalIterator folds an optional subbranch into the And. It will
+// never be nexted or gate Check(), but it still gets a chance to tag.
+func (it *AndIterator) AddOptionalIterator(sub Iterator) {
+	it.opt = append(it.opt, sub)
+}
+
+func (it *AndIterator) allSubIts() []Iterator {
+	out := make([]Iterator, 0, len(it.subIts)+1)
+	if it.primaryIt != nil {
+		out = append(out, it.primaryIt)
+	}
+	return append(out, it.subIts...)
+}
+
+func (it *AndIterator) Reset() {
+	if it.primaryIt != nil {
+		it.primaryIt.Reset()
+	}
+	for _, sub := range it.subIts {
+		sub.Reset()
+	}
+	for _, sub := range it.opt {
+		sub.Reset()
+	}
+}
+
+func (it *AndIterator) Close() {
+	if it.primaryIt != nil {
+		it.primaryIt.Close()
+	}
+	for _, sub := range it.subIts {
+		sub.Close()
+	}
+	for _, sub := range it.opt {
+		sub.Close()
+	}
+}
+
+func (it *AndIterator) Clone() Iterator {
+	var subs []Iterator
+	if it.primaryIt != nil {
+		subs = append(subs, it.primaryIt.Clone())
+	}
+	for _, sub := range it.subIts {
+		subs = append(subs, sub.Clone())
+	}
+	out := NewAndIterator(subs...)
+	for _, sub := range it.opt {
+		out.AddOptionalIterator(sub.Clone())
+	}
+	out.CopyTagsFrom(it)
+	return out
+}
+
+// Next advances the primary subiterator and checks the resulting value
+// against every other sub (in ascending check-cost order), short-circuiting
+// on the first miss.
+func (it *AndIterator) Next() (TSVal, bool) {
+	if it.primaryIt == nil {
+		return nil, false
+	}
+	for {
+		val, ok := it.primaryIt.Next()
+		if !ok {
+			return nil, false
+		}
+		if it.checkSubs(val) {
+			it.Last = val
+			return val, true
+		}
+	}
+}
+
+// checkSubs runs Check() against every non-primary sub (in checkList order,
+// falling back to subIts if Optimize() has not run yet) plus the opt
+// subbranches, short-circuiting on the first false.
+func (it *AndIterator) checkSubs(val TSVal) bool {
+	list := it.checkList
+	if list == nil {
+		list = it.subIts
+	}
+	for _, sub := range list {
+		if !sub.Check(val) {
+			return false
+		}
+	}
+	for _, sub := range it.opt {
+		sub.Check(val)
+	}
+	return true
+}
+
+func (it *AndIterator) NextResult() bool {
+	if it.primaryIt == nil {
+		return false
+	}
+	if it.primaryIt.NextResult() {
+		return true
+	}
+	for _, sub := range it.allSubIts() {
+		if sub.NextResult() {
+			return true
+		}
+	}
+	return false
+}
+
+// Check logically ANDs Check() across every subiterator, short-circuiting on
+// the first false. An And with no subiterators matches nothing.
+func (it *AndIterator) Check(val TSVal) bool {
+	if it.primaryIt == nil {
+		return false
+	}
+	for _, sub := range it.allSubIts() {
+		if !sub.Check(val) {
+			return false
+		}
+	}
+	for _, sub := range it.opt {
+		sub.Check(val)
+	}
+	it.Last = val
+	return true
+}
+
+// TagResults fans out to every subiterator, including folded-in optionals.
+func (it *AndIterator) TagResults(out *map[string]TSVal) {
+	it.BaseIterator.TagResults(out)
+	for _, sub := range it.allSubIts() {
+		sub.TagResults(out)
+	}
+	for _, sub := range it.opt {
+		sub.TagResults(out)
+	}
+}
+
+func (it *AndIterator) Type() string { return "and" }
+
+func (it *AndIterator) DebugString(indent int) string {
+	var subs []string
+	for _, sub := range it.allSubIts() {
+		subs = append(subs, sub.DebugString(indent+4))
+	}
+	for _, sub := range it.opt {
+		subs = append(subs, sub.DebugString(indent+4))
+	}
+	return fmt.Sprintf("%s(%s tags:%s\n%s)",
+		strings.Repeat(" ", indent),
+		it.Type(),
+		it.Tags(),
+		strings.Join(subs, "\n"))
+}
+
+// Optimize recursively optimizes every child, promotes the cheapest sub to
+// primary by Size (passing over OptionalIterator subs unless nothing else is
+// left), reorders the checkList by ascending CheckCost and collapses nested
+// Ands. Like OptionalIterator.Optimize() and MaterializeIterator.Optimize(),
+// it always hands back its own receiver -- never a different object -- so it
+// always reports changed=false, even though it mutates its children in
+// place; a replaced child is closed before being discarded, same as the
+// other iterators in this package do.
+//
+// Known gap: this does not drop children that always match. Doing so needs
+// some iterator-independent way to ask "does this match everything?", and
+// nothing in this package represents that yet -- there's no sentinel on
+// IteratorStats or marker interface for an always-true iterator to
+// implement. Revisit once such a thing exists.
+func (it *AndIterator) Optimize() (Iterator, bool) {
+	all := it.allSubIts()
+	newSubs := make([]Iterator, 0, len(all))
+	for _, sub := range all {
+		newSub, subChanged := sub.Optimize()
+		if subChanged {
+			sub.Close()
+		}
+		if nested, ok := newSub.(*AndIterator); ok {
+			newSubs = append(newSubs, nested.allSubIts()...)
+			it.opt = append(it.opt, nested.opt...)
+			continue
+		}
+		newSubs = append(newSubs, newSub)
+	}
+	newOpt := make([]Iterator, 0, len(it.opt))
+	for _, sub := range it.opt {
+		newSub, subChanged := sub.Optimize()
+		if subChanged {
+			sub.Close()
+		}
+		newOpt = append(newOpt, newSub)
+	}
+	it.opt = newOpt
+
+	if len(newSubs) == 0 {
+		return it, false
+	}
+
+	// Promote the smallest Size sub to primary. An OptionalIterator cannot be
+	// nexted, so it is only picked when every sub is one.
+	best := -1
+	var bestSize int64
+	for i, sub := range newSubs {
+		if _, isOpt := sub.(*OptionalIterator); isOpt {
+			continue
+		}
+		if s := sub.GetStats().Size; best < 0 || s < bestSize {
+			best, bestSize = i, s
+		}
+	}
+	if best < 0 {
+		best = 0
+	}
+	it.primaryIt = newSubs[best]
+	it.subIts = append(newSubs[:best:best], newSubs[best+1:]...)
+
+	// Reorder checkList by ascending CheckCost.
+	it.checkList = append([]Iterator(nil), it.subIts...)
+	sort.Sort(byCheckCost(it.checkList))
+
+	return it, false
+}
+
+type byCheckCost []Iterator
+
+func (c byCheckCost) Len() int      { return len(c) }
+func (c byCheckCost) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byCheckCost) Less(i, j int) bool {
+	return c[i].GetStats().CheckCost < c[j].GetStats().CheckCost
+}
+
+// GetStats computes NextCost as the primary's NextCost plus the sum of every
+// other sub's CheckCost, and Size as the smallest sub Size (the intersection
+// can never be larger than its smallest input).
+func (it *AndIterator) GetStats() *IteratorStats {
+	if it.primaryIt == nil {
+		return &IteratorStats{}
+	}
+	primaryStats := it.primaryIt.GetStats()
+	nextCost := primaryStats.NextCost
+	checkCost := primaryStats.CheckCost
+	size := primaryStats.Size
+	for _, sub := range it.subIts {
+		stats := sub.GetStats()
+		nextCost += stats.CheckCost
+		checkCost += stats.CheckCost
+		if stats.Size < size {
+			size = stats.Size
+		}
+	}
+	for _, sub := range it.opt {
+		stats := sub.GetStats()
+		nextCost += stats.CheckCost
+		checkCost += stats.CheckCost
+	}
+	return &IteratorStats{
+		CheckCost: checkCost,
+		NextCost:  nextCost,
+		Size:      size,
+	}
+}
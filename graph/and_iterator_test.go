@@ -0,0 +1,78 @@
+// Copyright 2014 The Cayley Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+import "testing"
+
+func TestAndIteratorEmpty(t *testing.T) {
+	it := NewAndIterator()
+	if _, ok := it.Next(); ok {
+		t.Error("Next() on an empty And should report no results")
+	}
+	if it.Check(TSVal(1)) {
+		t.Error("Check() on an empty And should fail closed, not vacuously succeed")
+	}
+	stats := it.GetStats()
+	if stats.NextCost != 0 || stats.CheckCost != 0 || stats.Size != 0 {
+		t.Errorf("GetStats() on an empty And = %+v, want all zero", stats)
+	}
+	if it.NextResult() {
+		t.Error("NextResult() on an empty And should be false")
+	}
+}
+
+func TestAndIteratorNextShortCircuits(t *testing.T) {
+	primary := newStubIterator("primary", TSVal(1), TSVal(2), TSVal(3))
+	onlyTwo := newStubIterator("onlyTwo", TSVal(2))
+	it := NewAndIterator(primary, onlyTwo)
+
+	val, ok := it.Next()
+	if !ok || val != TSVal(2) {
+		t.Fatalf("Next() = %v, %v, want 2, true", val, ok)
+	}
+	if _, ok := it.Next(); ok {
+		t.Error("Next() should have no more matches after the only intersection")
+	}
+}
+
+func TestAndIteratorCheckShortCircuits(t *testing.T) {
+	a := newStubIterator("a", TSVal(1), TSVal(2))
+	b := newStubIterator("b", TSVal(2), TSVal(3))
+	it := NewAndIterator(a, b)
+
+	if it.Check(TSVal(1)) {
+		t.Error("Check(1) should fail: b doesn't have 1")
+	}
+	if !it.Check(TSVal(2)) {
+		t.Error("Check(2) should succeed: both a and b have 2")
+	}
+}
+
+func TestAndIteratorOptTagFanout(t *testing.T) {
+	primary := newStubIterator("primary", TSVal(1))
+	opt := newStubIterator("opt", TSVal(1)).withTag("opttag")
+	it := NewAndIterator(primary)
+	it.AddOptionalIterator(opt)
+
+	val, ok := it.Next()
+	if !ok || val != TSVal(1) {
+		t.Fatalf("Next() = %v, %v, want 1, true", val, ok)
+	}
+	out := make(map[string]TSVal)
+	it.TagResults(&out)
+	if out["opttag"] != TSVal(1) {
+		t.Errorf("TagResults() = %v, want opttag=1 fanned out from the opt sub", out)
+	}
+}
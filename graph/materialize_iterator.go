@@ -0,0 +1,236 @@
+// Copyright 2014 The Cayley Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+// MaterializeIterator drains its subiterator into memory the first time it
+// is used, trading a one-time Next()-everything pass for an O(1) Check() and
+// a cheap Next() afterwards. This is most useful for subtrees that get
+// Check()ed many times over by an enclosing And -- paying the full
+// iteration cost once is far cheaper than paying CheckCost on every probe.
+// Materialization drains the sub with Next(), so an un-nextable sub (like
+// OptionalIterator, whose Next() returns nothing) materializes no values,
+// and Check() then misses every value.
+//
+// If the subiterator turns out to be larger than maxSize, materialization is
+// aborted and the iterator falls back to driving the sub directly, so a
+// surprising blowup in size doesn't turn into an unbounded memory hog.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/barakmich/glog"
+)
+
+// DefaultMaterializeLimit is the default cap on the number of values an
+// unconfigured MaterializeIterator will hold in memory before giving up.
+const DefaultMaterializeLimit = 1 << 20
+
+// MaterializeIterator caches the output of its subiterator in memory.
+type MaterializeIterator struct {
+	BaseIterator
+	subIt       Iterator
+	maxSize     int
+	hasRun      bool
+	aborted     bool
+	values      []TSVal
+	index       map[TSVal][]map[string]TSVal
+	lastIndex   int
+	curSnaps    []map[string]TSVal
+	resultIndex int
+}
+
+// NewMaterializeIterator creates a new MaterializeIterator wrapping sub,
+// using the DefaultMaterializeLimit as the cap on materialized values.
+func NewMaterializeIterator(sub Iterator) *MaterializeIterator {
+	var it MaterializeIterator
+	BaseIteratorInit(&it.BaseIterator)
+	it.subIt = sub
+	it.maxSize = DefaultMaterializeLimit
+	it.lastIndex = -1
+	return &it
+}
+
+// SetMaxSize overrides the default cap on the number of values to
+// materialize before falling through to the underlying subiterator.
+func (it *MaterializeIterator) SetMaxSize(n int) {
+	it.maxSize = n
+}
+
+// materialize drains subIt into values and index, recording every tag
+// binding seen for each value along the way. If Next() returns more than
+// maxSize values (duplicates included), it gives up and leaves aborted set so Next/Check fall
+// through to subIt directly.
+func (it *MaterializeIterator) materialize() {
+	it.hasRun = true
+	it.index = make(map[TSVal][]map[string]TSVal)
+	for {
+		val, ok := it.subIt.Next()
+		if !ok {
+			break
+		}
+		if len(it.values) >= it.maxSize {
+			glog.V(2).Infoln("Aborting materialization; subiterator too large")
+			it.aborted = true
+			it.values = nil
+			it.index = nil
+			// The drained-but-discarded pass above already consumed every
+			// value up to the cap; without a Reset() here, Next/Check falling
+			// through to subIt would silently resume past them instead of
+			// replaying from the start.
+			it.subIt.Reset()
+			return
+		}
+		it.values = append(it.values, val)
+		it.captureTags(val)
+		for it.subIt.NextResult() {
+			it.captureTags(val)
+		}
+	}
+}
+
+func (it *MaterializeIterator) captureTags(val TSVal) {
+	tags := make(map[string]TSVal)
+	it.subIt.TagResults(&tags)
+	it.index[val] = append(it.index[val], tags)
+}
+
+func (it *MaterializeIterator) Reset() {
+	if it.aborted {
+		it.subIt.Reset()
+		return
+	}
+	it.lastIndex = -1
+	it.curSnaps = nil
+	it.resultIndex = 0
+}
+
+func (it *MaterializeIterator) Close() {
+	it.subIt.Close()
+}
+
+func (it *MaterializeIterator) Clone() Iterator {
+	out := NewMaterializeIterator(it.subIt.Clone())
+	out.maxSize = it.maxSize
+	out.CopyTagsFrom(it)
+	return out
+}
+
+// Next walks the materialized slice once populated; until then it forces
+// materialization (or, if that was aborted, simply delegates to subIt).
+func (it *MaterializeIterator) Next() (TSVal, bool) {
+	if !it.hasRun {
+		it.materialize()
+	}
+	if it.aborted {
+		return it.subIt.Next()
+	}
+	it.lastIndex++
+	if it.lastIndex >= len(it.values) {
+		return nil, false
+	}
+	it.Last = it.values[it.lastIndex]
+	it.curSnaps = it.index[it.Last]
+	it.resultIndex = 0
+	return it.Last, true
+}
+
+// NextResult walks the captured tag-binding snapshots for the current value
+// so downstream iterators still observe every binding a repeated Next would
+// have produced against the live subiterator.
+func (it *MaterializeIterator) NextResult() bool {
+	if it.aborted {
+		return it.subIt.NextResult()
+	}
+	it.resultIndex++
+	return it.resultIndex < len(it.curSnaps)
+}
+
+// Check becomes an O(1) map lookup once materialized.
+func (it *MaterializeIterator) Check(val TSVal) bool {
+	if !it.hasRun {
+		it.materialize()
+	}
+	if it.aborted {
+		return it.subIt.Check(val)
+	}
+	snaps, ok := it.index[val]
+	if !ok {
+		return false
+	}
+	it.Last = val
+	it.curSnaps = snaps
+	it.resultIndex = 0
+	return true
+}
+
+// TagResults copies across the tags captured for the current value.
+func (it *MaterializeIterator) TagResults(out *map[string]TSVal) {
+	it.BaseIterator.TagResults(out)
+	if it.aborted {
+		it.subIt.TagResults(out)
+		return
+	}
+	if it.resultIndex >= len(it.curSnaps) {
+		return
+	}
+	for k, v := range it.curSnaps[it.resultIndex] {
+		(*out)[k] = v
+	}
+}
+
+func (it *MaterializeIterator) Type() string { return "materialize" }
+
+func (it *MaterializeIterator) DebugString(indent int) string {
+	return fmt.Sprintf("%s(%s tags:%s\n%s)",
+		strings.Repeat(" ", indent),
+		it.Type(),
+		it.Tags(),
+		it.subIt.DebugString(indent+4))
+}
+
+// Optimize optimizes the subiterator and potentially replaces it; the
+// materialization cache is dropped so it gets rebuilt against the new sub.
+func (it *MaterializeIterator) Optimize() (Iterator, bool) {
+	newSub, changed := it.subIt.Optimize()
+	if changed {
+		it.subIt.Close()
+		it.subIt = newSub
+		it.hasRun = false
+		it.aborted = false
+		it.values = nil
+		it.index = nil
+	}
+	return it, false
+}
+
+// GetStats reports the cheap, post-materialization costs: once the values
+// are in memory, both Next and Check are effectively O(1). If a previous
+// materialization pass was aborted for being too large, Next/Check fall
+// through to subIt directly, so report subIt's own costs instead -- feeding
+// the planner the optimistic 1/1 numbers once materialization has already
+// failed would make it pick a plan that's wrong for how this iterator
+// actually behaves now.
+func (it *MaterializeIterator) GetStats() *IteratorStats {
+	subStats := it.subIt.GetStats()
+	if it.aborted {
+		return subStats
+	}
+	return &IteratorStats{
+		NextCost:  1,
+		CheckCost: 1,
+		Size:      subStats.Size,
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 The Cayley Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+import "testing"
+
+func TestMaterializeIteratorBasic(t *testing.T) {
+	sub := newStubIterator("sub", TSVal(1), TSVal(2), TSVal(3)).withTag("tag")
+	it := NewMaterializeIterator(sub)
+
+	var got []TSVal
+	for {
+		val, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, val)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Next() produced %v, want 3 values", got)
+	}
+	if !it.Check(TSVal(2)) {
+		t.Error("Check(2) should be an O(1) hit after materialization")
+	}
+	out := make(map[string]TSVal)
+	it.TagResults(&out)
+	if out["tag"] != TSVal(2) {
+		t.Errorf("TagResults() after Check(2) = %v, want the captured binding for 2", out)
+	}
+	if it.Check(TSVal(99)) {
+		t.Error("Check(99) should miss: never produced by sub")
+	}
+	stats := it.GetStats()
+	if stats.NextCost != 1 || stats.CheckCost != 1 {
+		t.Errorf("GetStats() after a clean materialization = %+v, want NextCost=CheckCost=1", stats)
+	}
+}
+
+func TestMaterializeIteratorAbortResetsSub(t *testing.T) {
+	sub := newStubIterator("sub", TSVal(1), TSVal(2), TSVal(3)).withStats(5, 7, 3)
+	it := NewMaterializeIterator(sub)
+	it.SetMaxSize(2)
+
+	// The very first Next() call drains sub past maxSize, aborts the
+	// materialization attempt, and falls through to sub directly -- which
+	// must have been Reset() first, or this call (and the ones after it)
+	// would silently skip the values the failed attempt already consumed.
+	var got []TSVal
+	for {
+		val, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, val)
+	}
+	if !it.aborted {
+		t.Fatal("materialization should have aborted once it exceeded maxSize")
+	}
+	if sub.resets == 0 {
+		t.Error("aborting materialization should Reset() the subiterator so the abort-then-fall-through path replays from the start")
+	}
+	if len(got) != 3 {
+		t.Errorf("Next() after abort-and-reset produced %v, want all 3 values replayed", got)
+	}
+
+	stats := it.GetStats()
+	if stats.NextCost != 5 || stats.CheckCost != 7 {
+		t.Errorf("GetStats() after an aborted materialization = %+v, want sub's real costs (NextCost=5, CheckCost=7), not the optimistic 1/1", stats)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 The Cayley Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+// NotIterator is the negation counterpart to OptionalIterator. Where
+// OptionalIterator is the regex '?', Not is the regex '!' -- it matches
+// everything except whatever its subconstraint matches. Since there is no
+// way to "Next()" the complement of an iterator without some notion of the
+// full universe, Not needs to be handed an `all` iterator to walk, same as
+// the reasonable refactor of OptionalIterator mentioned in
+// optional_iterator.go would need.
+//
+// Like OptionalIterator, Not never contributes tags -- negation binds no
+// variables, it only filters.
+//
+// The Gremlin/GraphQL query surfaces that would expose this as `.Except(...)`
+// live outside this module's chunk of the tree and aren't present here, so
+// that wiring isn't included in this change.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NotIterator filters an `all` iterator down to the values that fail to
+// match the given subconstraint.
+type NotIterator struct {
+	BaseIterator
+	subIt Iterator
+	allIt Iterator
+}
+
+// NewNotIterator creates a new Not iterator. sub is the subconstraint being
+// negated; all is the iterator Next() walks to find candidates.
+func NewNotIterator(sub Iterator, all Iterator) *NotIterator {
+	var it NotIterator
+	BaseIteratorInit(&it.BaseIterator)
+	it.subIt = sub
+	it.allIt = all
+	return &it
+}
+
+func (it *NotIterator) Reset() {
+	it.subIt.Reset()
+	it.allIt.Reset()
+}
+
+func (it *NotIterator) Close() {
+	it.subIt.Close()
+	it.allIt.Close()
+}
+
+func (it *NotIterator) Clone() Iterator {
+	out := NewNotIterator(it.subIt.Clone(), it.allIt.Clone())
+	out.CopyTagsFrom(it)
+	return out
+}
+
+// Next walks the `all` iterator, skipping anything the subconstraint
+// matches, and returns the first value that doesn't.
+func (it *NotIterator) Next() (TSVal, bool) {
+	for {
+		val, ok := it.allIt.Next()
+		if !ok {
+			return nil, false
+		}
+		if !it.subIt.Check(val) {
+			it.Last = val
+			return val, true
+		}
+	}
+}
+
+func (it *NotIterator) NextResult() bool {
+	return it.allIt.NextResult()
+}
+
+// Check returns the negation of the subconstraint's Check.
+func (it *NotIterator) Check(val TSVal) bool {
+	result := !it.subIt.Check(val)
+	it.Last = val
+	return result
+}
+
+// TagResults is a no-op -- negation binds no variables.
+func (it *NotIterator) TagResults(out *map[string]TSVal) {}
+
+func (it *NotIterator) Type() string { return "not" }
+
+func (it *NotIterator) DebugString(indent int) string {
+	return fmt.Sprintf("%s(%s tags:%s\n%s\n%s)",
+		strings.Repeat(" ", indent),
+		it.Type(),
+		it.Tags(),
+		it.subIt.DebugString(indent+4),
+		it.allIt.DebugString(indent+4))
+}
+
+// Optimize recurses into both children and folds double negation
+// (Not(Not(x)) -> x), since negating twice is the identity.
+//
+// No De Morgan rewriting is done: Not(And(a, b)) is equivalent to
+// Or(Not(a), Not(b)), and this package has no Or iterator to rewrite it
+// into, so a negated And is left as it is.
+func (it *NotIterator) Optimize() (Iterator, bool) {
+	newSub, subChanged := it.subIt.Optimize()
+	if subChanged {
+		it.subIt.Close()
+		it.subIt = newSub
+	}
+	newAll, allChanged := it.allIt.Optimize()
+	if allChanged {
+		it.allIt.Close()
+		it.allIt = newAll
+	}
+
+	// Not(Not(sub2, allInner), allOuter) collapses to sub2 itself: Check()
+	// on the outer Not is !( !sub2.Check(v) ) == sub2.Check(v), independent
+	// of either `all` iterator, so both allInner and allOuter are dropped
+	// and sub2 -- the actually-negated constraint -- is what's left over.
+	// Both discarded `all` iterators are closed before we hand back a
+	// different object.
+	if inner, ok := it.subIt.(*NotIterator); ok {
+		it.allIt.Close()
+		inner.allIt.Close()
+		return inner.subIt, true
+	}
+
+	// Like every other Optimize() in this file set, we otherwise always hand
+	// back our own receiver -- never a different object -- so changed is
+	// always false here, even though subIt/allIt may have been replaced in
+	// place above.
+	return it, false
+}
+
+// GetStats mirrors the subiterator's cost for Check purposes, but NextCost
+// is driven by the `all` iterator since that's what actually gets walked.
+func (it *NotIterator) GetStats() *IteratorStats {
+	subStats := it.subIt.GetStats()
+	allStats := it.allIt.GetStats()
+	return &IteratorStats{
+		CheckCost: subStats.CheckCost,
+		NextCost:  allStats.NextCost,
+		Size:      allStats.Size,
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2014 The Cayley Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+import "testing"
+
+func TestNotIteratorCheckAndNext(t *testing.T) {
+	all := newStubIterator("all", TSVal(1), TSVal(2), TSVal(3))
+	sub := newStubIterator("sub", TSVal(2))
+	it := NewNotIterator(sub, all)
+
+	if it.Check(TSVal(2)) {
+		t.Error("Check(2) should fail: sub matches 2")
+	}
+	if !it.Check(TSVal(1)) {
+		t.Error("Check(1) should succeed: sub doesn't match 1")
+	}
+
+	var got []TSVal
+	for {
+		val, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, val)
+	}
+	if len(got) != 2 || got[0] != TSVal(1) || got[1] != TSVal(3) {
+		t.Errorf("Next() walked to %v, want [1 3] (everything in all except what sub matches)", got)
+	}
+}
+
+func TestNotIteratorDoubleNegationFolds(t *testing.T) {
+	sub2 := newStubIterator("sub2", TSVal(1))
+	allInner := newStubIterator("allInner", TSVal(1), TSVal(2))
+	inner := NewNotIterator(sub2, allInner)
+
+	allOuter := newStubIterator("allOuter", TSVal(1), TSVal(2), TSVal(3))
+	outer := NewNotIterator(inner, allOuter)
+
+	got, changed := outer.Optimize()
+	if !changed {
+		t.Fatal("Optimize() should report changed=true when folding double negation")
+	}
+	if got != Iterator(sub2) {
+		t.Fatalf("Optimize() = %v, want the doubly-negated sub2 itself", got)
+	}
+	if !allInner.closed || !allOuter.closed {
+		t.Error("double-negation fold should Close() both now-unused `all` iterators")
+	}
+}
+
+func TestNotIteratorTagResultsNoop(t *testing.T) {
+	all := newStubIterator("all", TSVal(1))
+	sub := newStubIterator("sub", TSVal(2)).withTag("tag")
+	it := NewNotIterator(sub, all)
+	it.Check(TSVal(1))
+
+	out := make(map[string]TSVal)
+	it.TagResults(&out)
+	if len(out) != 0 {
+		t.Errorf("TagResults() = %v, want empty: negation binds no variables", out)
+	}
+}
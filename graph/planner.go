@@ -0,0 +1,199 @@
+// Copyright 2014 The Cayley Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+// Planner is a global, cost-based join-order optimizer. AndIterator.Optimize
+// already picks a single primary sub by Size and leaves the rest in
+// ascending CheckCost order, which is a fine greedy approximation but not
+// optimal once there are more than a couple of subiterators: picking the
+// right primary for the *outer* And can make a very different set of
+// CheckCost sums possible for inner Ands further down the plan.
+//
+// Planner instead walks the whole tree once per query, collects
+// IteratorStats bottom-up, and for every And node re-derives its join order
+// with a Selinger-style dynamic program: for each subset of its
+// subiterators, compute the cheapest left-deep plan as
+//
+//	best(S) = min over proper nonempty subset L of S, R = S - L of
+//	          best(L).NextCost + best(L).Size * best(R).CheckCost
+//
+// memoized by subset bitset. Optional subbranches held in AndIterator.opt are
+// never part of the DP -- since their NextCost is 1<<62 they are always
+// attached after the planned subs. An OptionalIterator passed to an And as an
+// ordinary sub goes through the DP like any other sub.
+//
+// Pushing HasA/LinksTo predicates down and merging adjacent Fixed iterators
+// are left for whoever adds those iterator types to this module -- neither
+// exists in this chunk of the tree yet, so there's nothing here to push
+// into or merge.
+
+import (
+	"github.com/barakmich/glog"
+)
+
+// planEnabled gates whether OptimizeQuery runs the DP planner at all; when
+// false, iterators fall back to their own Optimize() as before.
+var planEnabled = false
+
+// maxPlannedSubs bounds how many subiterators of a single And clause the DP
+// will plan. The DP is O(3^n) over subsets, so this has to stay small
+// enough to actually finish -- not just small enough to avoid running out
+// of memory.
+const maxPlannedSubs = 12
+
+// EnablePlanner turns the cost-based planner on or off. It is off by default
+// so existing callers that only expect per-iterator Optimize() keep their
+// current behavior until they opt in.
+func EnablePlanner(on bool) {
+	planEnabled = on
+}
+
+// planNode is one memoized entry in the DP table: the cheapest plan found so
+// far for a given subset of subiterators, along with its combined stats and
+// the split that produced it (so the winning tree can be rebuilt).
+type planNode struct {
+	stats    *IteratorStats
+	subs     []Iterator // left-deep order for this subset
+	leftMask uint64
+}
+
+// OptimizeQuery is the entry point invoked once at query execution start. It
+// walks the iterator tree, and if the planner is enabled, rewrites any
+// AndIterator it finds into its cheapest left-deep join order.
+func OptimizeQuery(it Iterator) Iterator {
+	out, _ := it.Optimize()
+	if !planEnabled {
+		return out
+	}
+	return planTree(out)
+}
+
+// planTree walks the whole iterator tree, not just And nodes reachable
+// through another And's allSubIts(). An And nested inside a Not, Optional,
+// or Materialize subtree still needs its join order re-derived, so each of
+// those wrapper types is recursed into explicitly here.
+func planTree(it Iterator) Iterator {
+	switch v := it.(type) {
+	case *AndIterator:
+		return planAnd(v)
+	case *NotIterator:
+		v.subIt = planTree(v.subIt)
+		v.allIt = planTree(v.allIt)
+		return v
+	case *MaterializeIterator:
+		v.subIt = planTree(v.subIt)
+		return v
+	case *OptionalIterator:
+		v.subIt = planTree(v.subIt)
+		return v
+	default:
+		return it
+	}
+}
+
+// planAnd recursively plans every subiterator, then re-derives the join
+// order for and itself via the DP described above.
+func planAnd(and *AndIterator) Iterator {
+	subs := and.allSubIts()
+	for i, sub := range subs {
+		subs[i] = planTree(sub)
+	}
+	for i, opt := range and.opt {
+		and.opt[i] = planTree(opt)
+	}
+	if len(subs) == 0 {
+		return and
+	}
+	if len(subs) > maxPlannedSubs {
+		// The DP enumerates every submask of every mask, i.e. O(3^n); even
+		// n=20 is already billions of operations for a single And clause,
+		// and a dozen-plus intersected constraints is an ordinary Gremlin
+		// query, not an edge case. Beyond maxPlannedSubs, keep
+		// AndIterator.Optimize's greedy order instead.
+		glog.V(2).Infoln("planner: too many subiterators to plan, keeping greedy order")
+		return and
+	}
+
+	best := bestJoinOrder(subs)
+	out := NewAndIterator(best.subs...)
+	for _, opt := range and.opt {
+		out.AddOptionalIterator(opt)
+	}
+	glog.V(2).Infof("planner: chose join order %v (NextCost=%d Size=%d)",
+		debugTypes(best.subs), best.stats.NextCost, best.stats.Size)
+	return out
+}
+
+func debugTypes(subs []Iterator) []string {
+	var out []string
+	for _, s := range subs {
+		out = append(out, s.Type())
+	}
+	return out
+}
+
+// bestJoinOrder runs the Selinger-style DP over all 2^n-1 nonempty subsets
+// of subs and returns the cheapest left-deep plan for the full set.
+func bestJoinOrder(subs []Iterator) *planNode {
+	n := uint(len(subs))
+	memo := make(map[uint64]*planNode, 1<<n)
+
+	// Base case: singleton subsets cost exactly what the sub itself costs.
+	for i, sub := range subs {
+		mask := uint64(1) << uint(i)
+		memo[mask] = &planNode{
+			stats: sub.GetStats(),
+			subs:  []Iterator{sub},
+		}
+	}
+
+	full := uint64(1)<<n - 1
+	for mask := uint64(1); mask <= full; mask++ {
+		if memo[mask] != nil {
+			continue // singleton, already seeded above
+		}
+		var bestNode *planNode
+		for left := (mask - 1) & mask; left > 0; left = (left - 1) & mask {
+			right := mask &^ left
+			if right == 0 {
+				continue
+			}
+			leftPlan, leftOK := memo[left]
+			rightPlan, rightOK := memo[right]
+			if !leftOK || !rightOK {
+				continue
+			}
+			cost := leftPlan.stats.NextCost + leftPlan.stats.Size*rightPlan.stats.CheckCost
+			if bestNode == nil || cost < bestNode.stats.NextCost {
+				size := leftPlan.stats.Size
+				if rightPlan.stats.Size < size {
+					size = rightPlan.stats.Size
+				}
+				bestNode = &planNode{
+					stats: &IteratorStats{
+						NextCost:  cost,
+						CheckCost: leftPlan.stats.CheckCost + rightPlan.stats.CheckCost,
+						Size:      size,
+					},
+					subs:     append(append([]Iterator{}, leftPlan.subs...), rightPlan.subs...),
+					leftMask: left,
+				}
+			}
+		}
+		memo[mask] = bestNode
+	}
+
+	return memo[full]
+}
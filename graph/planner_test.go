@@ -0,0 +1,65 @@
+// Copyright 2014 The Cayley Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+import "testing"
+
+func TestBestJoinOrderPicksCheaperPrimary(t *testing.T) {
+	// A cheap-to-next, small primary plus two very expensive-to-check subs
+	// should come out ahead of starting from one of the expensive subs.
+	cheap := newStubIterator("cheap").withStats(1, 1, 10)
+	pricey1 := newStubIterator("pricey1").withStats(1000, 500, 10000)
+	pricey2 := newStubIterator("pricey2").withStats(1000, 500, 10000)
+
+	best := bestJoinOrder([]Iterator{pricey1, pricey2, cheap})
+	if best.subs[0] != Iterator(cheap) {
+		t.Fatalf("bestJoinOrder() led with %s, want the cheap sub first", best.subs[0].Type())
+	}
+}
+
+func TestBestJoinOrderSingleton(t *testing.T) {
+	only := newStubIterator("only").withStats(3, 4, 5)
+	best := bestJoinOrder([]Iterator{only})
+	if best.stats.NextCost != 3 || best.stats.CheckCost != 4 || best.stats.Size != 5 {
+		t.Errorf("bestJoinOrder() on one sub = %+v, want the sub's own stats unchanged", best.stats)
+	}
+}
+
+func TestPlanAndRebuildsPrimary(t *testing.T) {
+	cheap := newStubIterator("cheap").withStats(1, 1, 1)
+	pricey := newStubIterator("pricey").withStats(1000, 500, 10000)
+	and := NewAndIterator(pricey, cheap)
+
+	out := planAnd(and)
+	rebuilt, ok := out.(*AndIterator)
+	if !ok {
+		t.Fatalf("planAnd() returned %T, want *AndIterator", out)
+	}
+	if rebuilt.primaryIt != Iterator(cheap) {
+		t.Error("planAnd() should have promoted the cheap sub to primary")
+	}
+}
+
+func TestPlanAndSkipsOversizedSubsets(t *testing.T) {
+	subs := make([]Iterator, maxPlannedSubs+1)
+	for i := range subs {
+		subs[i] = newStubIterator("s")
+	}
+	and := NewAndIterator(subs...)
+	out := planAnd(and)
+	if out != Iterator(and) {
+		t.Error("planAnd() should fall back to the greedy order, unchanged, above maxPlannedSubs")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2014 The Cayley Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+// stubIterator is a minimal hand-rolled Iterator used across this file
+// set's tests. It walks a fixed slice of values, optionally tags each one
+// under a fixed key, and reports whatever stats the test configures --
+// there's no real quadstore behind it, just enough to exercise the
+// composite iterators' own logic.
+type stubIterator struct {
+	BaseIterator
+	name      string
+	values    []TSVal
+	checkSet  map[TSVal]bool
+	tagKey    string
+	pos       int
+	nextCost  int64
+	checkCost int64
+	size      int64
+	closed    bool
+	resets    int
+}
+
+func newStubIterator(name string, values ...TSVal) *stubIterator {
+	var it stubIterator
+	BaseIteratorInit(&it.BaseIterator)
+	it.name = name
+	it.values = values
+	it.pos = -1
+	it.nextCost = 1
+	it.checkCost = 1
+	it.size = int64(len(values))
+	if len(values) > 0 {
+		it.checkSet = make(map[TSVal]bool, len(values))
+		for _, v := range values {
+			it.checkSet[v] = true
+		}
+	}
+	return &it
+}
+
+// withTag makes every value this iterator produces tag key -> the value
+// itself, so tests can assert a tag fanned out from a given sub.
+func (it *stubIterator) withTag(key string) *stubIterator {
+	it.tagKey = key
+	return it
+}
+
+func (it *stubIterator) withStats(nextCost, checkCost, size int64) *stubIterator {
+	it.nextCost = nextCost
+	it.checkCost = checkCost
+	it.size = size
+	return it
+}
+
+func (it *stubIterator) Reset() {
+	it.pos = -1
+	it.resets++
+}
+
+func (it *stubIterator) Close() {
+	it.closed = true
+}
+
+func (it *stubIterator) Clone() Iterator {
+	out := newStubIterator(it.name, it.values...)
+	out.tagKey = it.tagKey
+	out.nextCost = it.nextCost
+	out.checkCost = it.checkCost
+	out.size = it.size
+	out.CopyTagsFrom(it)
+	return out
+}
+
+func (it *stubIterator) Next() (TSVal, bool) {
+	it.pos++
+	if it.pos >= len(it.values) {
+		return nil, false
+	}
+	it.Last = it.values[it.pos]
+	return it.Last, true
+}
+
+func (it *stubIterator) NextResult() bool { return false }
+
+func (it *stubIterator) Check(val TSVal) bool {
+	it.Last = val
+	return it.checkSet[val]
+}
+
+func (it *stubIterator) TagResults(out *map[string]TSVal) {
+	it.BaseIterator.TagResults(out)
+	if it.tagKey != "" && it.Last != nil {
+		(*out)[it.tagKey] = it.Last
+	}
+}
+
+func (it *stubIterator) Type() string { return "stub:" + it.name }
+
+func (it *stubIterator) DebugString(indent int) string { return it.Type() }
+
+func (it *stubIterator) Optimize() (Iterator, bool) { return it, false }
+
+func (it *stubIterator) GetStats() *IteratorStats {
+	return &IteratorStats{
+		NextCost:  it.nextCost,
+		CheckCost: it.checkCost,
+		Size:      it.size,
+	}
+}